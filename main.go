@@ -1,19 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jws"
 )
 
 var (
@@ -23,53 +30,543 @@ var (
 	}
 )
 
-func main() {
-	var bindHost = flag.String("host", "localhost:7900", "bind host")
-	var jsonKeyFile = flag.String("key", "key.json", "JSON key file")
-	flag.Parse()
+// credentialType is just the "type" field of a Google credential JSON file,
+// enough to tell a service-account key apart from an external_account one.
+type credentialType struct {
+	Type string `json:"type"`
+}
+
+// tokenSourceFromJSON builds a TokenSource from the given credential JSON.
+// Service-account keys keep going through google.JWTConfigFromJSON, unchanged
+// from before. Anything else - notably "external_account" credentials used by
+// Workload Identity Federation - is handed to google.CredentialsFromJSON,
+// which performs the STS token exchange (and any configured impersonation)
+// transparently.
+func tokenSourceFromJSON(ctx context.Context, keyData []byte, scopes ...string) (oauth2.TokenSource, error) {
+	var ct credentialType
+	if err := json.Unmarshal(keyData, &ct); err != nil {
+		return nil, err
+	}
+
+	if ct.Type == "" || ct.Type == "service_account" {
+		cfg, err := google.JWTConfigFromJSON(keyData, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.TokenSource(ctx), nil
+	}
+
+	creds, err := google.CredentialsFromJSON(ctx, keyData, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	return creds.TokenSource, nil
+}
+
+// serviceAccountKey holds the fields of a service-account JSON key needed to
+// mint ID tokens directly, without going through a TokenSource.
+type serviceAccountKey struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// mintIDToken signs a JWT bearer assertion with the service account's private
+// key - using "target_audience" instead of "scope", per Google's OAuth2
+// server-to-server flow - and exchanges it at the token endpoint for an ID
+// token. This mirrors what the real metadata server does for the `identity`
+// endpoint when no impersonation is configured. format is "standard" (the
+// default) or "full"; under "full" a "google" claim holding an empty
+// "compute_engine" object is added to the signed assertion. The returned ID
+// token is whatever the token endpoint issues for that assertion: this
+// function adds no project/instance details to it.
+func mintIDToken(keyData []byte, audience, format string) (string, error) {
+	var sa serviceAccountKey
+	if err := json.Unmarshal(keyData, &sa); err != nil {
+		return "", err
+	}
+	if sa.Type != "service_account" {
+		return "", fmt.Errorf("identity endpoint requires a service_account key, got %q", sa.Type)
+	}
+
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("invalid private key in JSON key file")
+	}
+	key, err := parseRSAPrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	privateClaims := map[string]interface{}{"target_audience": audience}
+	if format == "full" {
+		privateClaims["google"] = map[string]interface{}{"compute_engine": map[string]interface{}{}}
+	}
+
+	now := time.Now()
+	claims := &jws.ClaimSet{
+		Iss:           sa.ClientEmail,
+		Aud:           sa.TokenURI,
+		Iat:           now.Unix(),
+		Exp:           now.Add(time.Hour).Unix(),
+		PrivateClaims: privateClaims,
+	}
+	header := &jws.Header{Algorithm: "RS256", Typ: "JWT"}
+	assertion, err := jws.Encode(header, claims, key)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.PostForm(sa.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s: %s", resp.Status, respBody)
+	}
+
+	var result struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", err
+	}
+	if result.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned no id_token (status %s)", resp.Status)
+	}
+	return result.IDToken, nil
+}
 
-	keyFile, err := os.Open(*jsonKeyFile)
+// parseRSAPrivateKey accepts both PKCS#1 and PKCS#8 encodings, since Google
+// has issued service-account keys in either form over the years.
+func parseRSAPrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not RSA")
 	}
+	return key, nil
+}
 
-	keyData, err := ioutil.ReadAll(keyFile)
+// delegateResourceNames turns emails into the IAM Credentials resource names
+// a delegation chain expects: "projects/-/serviceAccounts/<email>".
+func delegateResourceNames(delegates []string) []string {
+	names := make([]string, len(delegates))
+	for i, d := range delegates {
+		names[i] = fmt.Sprintf("projects/-/serviceAccounts/%s", d)
+	}
+	return names
+}
+
+// impersonatedTokenSource exchanges a base token for one belonging to
+// targetPrincipal via IAM Credentials generateAccessToken.
+type impersonatedTokenSource struct {
+	base            oauth2.TokenSource
+	targetPrincipal string
+	delegates       []string
+	scopes          []string
+}
+
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	base, err := s.base.Token()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	cfg, err := google.JWTConfigFromJSON(keyData, scopes...)
+	reqBody, err := json.Marshal(struct {
+		Delegates []string `json:"delegates,omitempty"`
+		Scope     []string `json:"scope"`
+		Lifetime  string   `json:"lifetime"`
+	}{
+		Delegates: delegateResourceNames(s.delegates),
+		Scope:     s.scopes,
+		Lifetime:  "3600s",
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	tokenSrc := cfg.TokenSource(context.Background())
+	endpoint := fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken", s.targetPrincipal)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+base.AccessToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("generateAccessToken: %s: %s", resp.Status, respBody)
+	}
 
-	http.HandleFunc("/computeMetadata/v1/instance/service-accounts/default/token", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Intercepting token call from", r.RemoteAddr)
-		token, err := tokenSrc.Token()
+	var result struct {
+		AccessToken string `json:"accessToken"`
+		ExpireTime  string `json:"expireTime"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	if result.AccessToken == "" {
+		return nil, fmt.Errorf("generateAccessToken returned no accessToken (status %s)", resp.Status)
+	}
+	expiry, err := time.Parse(time.RFC3339, result.ExpireTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{
+		AccessToken: result.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
+
+// newImpersonatedTokenSource caches the impersonated token until expiry,
+// same as oauth2.ReuseTokenSource does for every other TokenSource here.
+func newImpersonatedTokenSource(base oauth2.TokenSource, targetPrincipal string, delegates []string, scopes []string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		base:            base,
+		targetPrincipal: targetPrincipal,
+		delegates:       delegates,
+		scopes:          scopes,
+	})
+}
+
+// mintIDTokenImpersonated calls IAM Credentials generateIdToken to obtain an
+// ID token for targetPrincipal, authenticating as base and following the
+// given delegation chain. Used instead of mintIDToken whenever -impersonate
+// is set, since we no longer hold the target's private key.
+func mintIDTokenImpersonated(base oauth2.TokenSource, targetPrincipal string, delegates []string, audience string) (string, error) {
+	token, err := base.Token()
+	if err != nil {
+		return "", err
+	}
+
+	reqBody, err := json.Marshal(struct {
+		Delegates    []string `json:"delegates,omitempty"`
+		Audience     string   `json:"audience"`
+		IncludeEmail bool     `json:"includeEmail"`
+	}{
+		Delegates:    delegateResourceNames(delegates),
+		Audience:     audience,
+		IncludeEmail: true,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateIdToken", targetPrincipal)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("generateIdToken: %s: %s", resp.Status, respBody)
+	}
+
+	var result struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", err
+	}
+	if result.Token == "" {
+		return "", fmt.Errorf("generateIdToken returned no token (status %s)", resp.Status)
+	}
+	return result.Token, nil
+}
+
+// account is one configured service account: keyData backs local ID-token
+// signing, baseTokenSrc authenticates IAM Credentials calls, and tokenSrc
+// serves the /token endpoint: baseTokenSrc itself, or an impersonated source
+// built on it when impersonate is set.
+type account struct {
+	email        string
+	keyData      []byte
+	baseTokenSrc oauth2.TokenSource
+	tokenSrc     oauth2.TokenSource
+	impersonate  string
+	delegates    []string
+}
+
+// loadAccount reads a JSON key file from disk and builds the account that
+// serves it. email, if set, overrides the routing label this account is
+// reachable under; it is independent of impersonate, this account's own
+// impersonation target (which may differ from every other configured
+// account), so a WIF key can be labeled without forcing an impersonation hop
+// it never asked for.
+func loadAccount(path, email, impersonate string, delegates []string) (*account, error) {
+	keyData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	baseTokenSrc, err := tokenSourceFromJSON(context.Background(), keyData, scopes...)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenSrc := baseTokenSrc
+	if impersonate != "" {
+		tokenSrc = newImpersonatedTokenSource(baseTokenSrc, impersonate, delegates, scopes)
+	}
+
+	if email == "" {
+		if impersonate != "" {
+			email = impersonate
+		} else {
+			var sa serviceAccountKey
+			json.Unmarshal(keyData, &sa)
+			email = sa.ClientEmail
+		}
+	}
+	if email == "" {
+		email = filepath.Base(path)
+	}
+
+	return &account{
+		email:        email,
+		keyData:      keyData,
+		baseTokenSrc: baseTokenSrc,
+		tokenSrc:     tokenSrc,
+		impersonate:  impersonate,
+		delegates:    delegates,
+	}, nil
+}
+
+// keySpec is one -key flag occurrence: a JSON key file path, optionally
+// followed by "|email=<addr>" and/or "|impersonate=<addr>". email sets this
+// entry's routing label explicitly - needed for WIF/external_account keys,
+// which have no client_email of their own and would otherwise collide on
+// filepath.Base(path) - while impersonate is this entry's own IAM Credentials
+// impersonation target. The two are independent: labeling an account doesn't
+// imply impersonating it.
+type keySpec struct {
+	path        string
+	email       string
+	impersonate string
+}
+
+// keyFileList collects a repeatable -key flag into an ordered slice, the
+// first entry being what the "default" account segment resolves to.
+type keyFileList []keySpec
+
+func (l *keyFileList) String() string {
+	paths := make([]string, len(*l))
+	for i, k := range *l {
+		paths[i] = k.path
+	}
+	return strings.Join(paths, ",")
+}
+
+func (l *keyFileList) Set(v string) error {
+	parts := strings.Split(v, "|")
+	spec := keySpec{path: parts[0]}
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid -key option %q, want email=<addr> or impersonate=<addr>", opt)
+		}
+		switch kv[0] {
+		case "email":
+			spec.email = kv[1]
+		case "impersonate":
+			spec.impersonate = kv[1]
+		default:
+			return fmt.Errorf("unknown -key option %q", kv[0])
+		}
+	}
+	*l = append(*l, spec)
+	return nil
+}
+
+const serviceAccountsPrefix = "/computeMetadata/v1/instance/service-accounts/"
+
+// withMetadataFlavor enforces and stamps the headers real GCE metadata server
+// responses carry. Google client libraries - including the cloud debugger
+// agent - refuse to trust a metadata endpoint that doesn't set them. Enforced
+// only when strict is true, so existing callers that don't send
+// Metadata-Flavor keep working by default.
+func withMetadataFlavor(strict bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strict {
+			if r.Header.Get("Metadata-Flavor") != "Google" || r.Header.Get("X-Forwarded-For") != "" {
+				http.Error(w, "Metadata-Flavor:Google header is required and X-Forwarded-For is not allowed", http.StatusForbidden)
+				return
+			}
+			hdr := w.Header()
+			hdr.Set("Metadata-Flavor", "Google")
+			hdr.Set("Server", "Metadata Server for VM")
+			hdr.Set("X-XSS-Protection", "0")
+			hdr.Set("X-Frame-Options", "SAMEORIGIN")
+		}
+		next(w, r)
+	}
+}
+
+func main() {
+	var bindHost = flag.String("host", "localhost:7900", "bind host")
+	var keyFiles keyFileList
+	flag.Var(&keyFiles, "key", "JSON key file, optionally followed by \"|email=<addr>\" and/or \"|impersonate=<addr>\" (repeatable; first one is used for the \"default\" account)")
+	var impersonate = flag.String("impersonate", "", "service account email to impersonate via IAM Credentials; used as the default target for -key entries that don't specify their own")
+	var delegatesFlag = flag.String("delegates", "", "comma-separated chain of delegate service accounts for impersonation")
+	var strict = flag.Bool("strict", false, "enforce Metadata-Flavor: Google and emulate real metadata server response headers")
+	flag.Parse()
+
+	if len(keyFiles) == 0 {
+		keyFiles = keyFileList{{path: "key.json", impersonate: *impersonate}}
+	}
+
+	var delegates []string
+	if *delegatesFlag != "" {
+		delegates = strings.Split(*delegatesFlag, ",")
+	}
+
+	var accounts []*account
+	byEmail := map[string]*account{}
+	for _, spec := range keyFiles {
+		target := spec.impersonate
+		if target == "" {
+			target = *impersonate
+		}
+		acc, err := loadAccount(spec.path, spec.email, target, delegates)
 		if err != nil {
-			log.Println(err)
+			panic(err)
+		}
+		if _, dup := byEmail[acc.email]; dup {
+			panic(fmt.Sprintf("duplicate service account %q across -key entries", acc.email))
+		}
+		accounts = append(accounts, acc)
+		byEmail[acc.email] = acc
+	}
+
+	lookupAccount := func(name string) *account {
+		if name == "default" {
+			return accounts[0]
+		}
+		return byEmail[name]
+	}
+
+	http.HandleFunc(serviceAccountsPrefix, withMetadataFlavor(*strict, func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, serviceAccountsPrefix), "/")
+		if rest == "" {
+			log.Println("Intercepting service-accounts list call from", r.RemoteAddr)
+			for _, acc := range accounts {
+				fmt.Fprintln(w, acc.email+"/")
+			}
 			return
 		}
 
-		json.NewEncoder(w).Encode(struct {
-			AccessToken string `json:"access_token"`
-			TokenType   string `json:"token_type"`
-			ExpiresIn   int    `json:"expires_in"`
-		}{
-			token.AccessToken,
-			token.TokenType,
-			int(token.Expiry.Sub(time.Now().UTC()).Seconds()),
-		})
-	})
+		segments := strings.SplitN(rest, "/", 2)
+		acc := lookupAccount(segments[0])
+		if acc == nil {
+			http.Error(w, fmt.Sprintf("no such service account %q", segments[0]), http.StatusNotFound)
+			return
+		}
+		if len(segments) < 2 {
+			fmt.Fprintln(w, "identity\nscopes\ntoken")
+			return
+		}
 
-	http.HandleFunc("/computeMetadata/v1/instance/service-accounts/default/scopes", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Intercepting scopes call from", r.RemoteAddr)
-		fmt.Fprintln(w, strings.Join(scopes, "\n"))
-	})
+		switch segments[1] {
+		case "token":
+			log.Println("Intercepting token call from", r.RemoteAddr)
+			token, err := acc.tokenSrc.Token()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			json.NewEncoder(w).Encode(struct {
+				AccessToken string `json:"access_token"`
+				TokenType   string `json:"token_type"`
+				ExpiresIn   int    `json:"expires_in"`
+			}{
+				token.AccessToken,
+				token.TokenType,
+				int(token.Expiry.Sub(time.Now().UTC()).Seconds()),
+			})
+
+		case "scopes":
+			log.Println("Intercepting scopes call from", r.RemoteAddr)
+			fmt.Fprintln(w, strings.Join(scopes, "\n"))
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		case "identity":
+			log.Println("Intercepting identity call from", r.RemoteAddr)
+			audience := r.URL.Query().Get("audience")
+			if audience == "" {
+				http.Error(w, "non-empty audience parameter required", http.StatusBadRequest)
+				return
+			}
+			format := r.URL.Query().Get("format")
+			if format != "" && format != "standard" && format != "full" {
+				http.Error(w, `format must be "standard" or "full"`, http.StatusBadRequest)
+				return
+			}
+
+			var idToken string
+			var err error
+			if acc.impersonate != "" {
+				// IAM Credentials' generateIdToken has no format parameter, so
+				// the standard/full distinction below only applies when we
+				// sign the JWT ourselves.
+				idToken, err = mintIDTokenImpersonated(acc.baseTokenSrc, acc.impersonate, acc.delegates, audience)
+			} else {
+				idToken, err = mintIDToken(acc.keyData, audience, format)
+			}
+			if err != nil {
+				log.Println(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, idToken)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	http.HandleFunc("/", withMetadataFlavor(*strict, func(w http.ResponseWriter, r *http.Request) {
 		req, err := http.NewRequest(r.Method, "http://metadata.google.internal"+r.URL.Path, r.Body)
 		if err != nil {
 			log.Println(err)
@@ -88,7 +585,7 @@ func main() {
 			}
 		}
 		io.Copy(w, resp.Body)
-	})
+	}))
 	log.Println("Proxy started on", *bindHost)
 	http.ListenAndServe(*bindHost, nil)
 }